@@ -0,0 +1,97 @@
+package gitbase
+
+import (
+	"io"
+	"path/filepath"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// PackfileAware is an optional interface a RowRepoIter implementation can
+// support to take over iteration with a packfile-order scan instead of
+// resolving objects one by one through go-git's Storer. rowRepoIter
+// prefers this path whenever both the RowRepoIter opts in and the
+// repository being scanned is backed by a single packfile, which is the
+// common case for siva-backed repositories and freshly cloned bare
+// repositories.
+type PackfileAware interface {
+	// NewPackfileIterator returns a RowRepoIter that walks pf in disk
+	// order rather than performing random-access object lookups against
+	// repo. It's used in place of NewIterator when applicable.
+	NewPackfileIterator(pf *packfile.Packfile, repo *Repository) (RowRepoIter, error)
+}
+
+// singlePackfile returns the packfile backing repo's object storage,
+// whether it was found, and a closer for the file descriptor opened to
+// read it. Callers that get ok == true must Close the returned closer
+// once they're done with pf, typically by closing it alongside the
+// RowRepoIter built from it. It only succeeds when the storage is a
+// single, filesystem-backed packfile; repositories with loose objects or
+// more than one packfile fall back to the regular per-object scan.
+func singlePackfile(repo *Repository) (pf *packfile.Packfile, closer io.Closer, ok bool) {
+	if repo == nil || repo.Repo == nil {
+		return nil, nil, false
+	}
+
+	sto, match := repo.Repo.Storer.(*filesystem.Storage)
+	if !match {
+		return nil, nil, false
+	}
+
+	packs, err := sto.ObjectPacks()
+	if err != nil || len(packs) != 1 {
+		return nil, nil, false
+	}
+
+	// Loose objects live under objects/<2 hex chars>/; any of them would be
+	// missed by a packfile-order scan.
+	objDirs, err := sto.Filesystem().ReadDir("objects")
+	if err != nil {
+		return nil, nil, false
+	}
+
+	for _, d := range objDirs {
+		if d.IsDir() && len(d.Name()) == 2 {
+			loose, err := sto.Filesystem().ReadDir(filepath.Join("objects", d.Name()))
+			if err != nil || len(loose) > 0 {
+				return nil, nil, false
+			}
+		}
+	}
+
+	f, err := sto.Filesystem().Open(
+		filepath.Join("objects", "pack", "pack-"+packs[0].String()+".pack"),
+	)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	pf, err = packfile.NewPackfile(f, sto.Filesystem(), sto)
+	if err != nil {
+		f.Close()
+		return nil, nil, false
+	}
+
+	return pf, f, true
+}
+
+// closingRowRepoIter wraps a RowRepoIter to also close an associated
+// io.Closer - the packfile's open file descriptor - when the iterator
+// itself is closed, so a PackfileAware RowRepoIter doesn't need to know
+// how singlePackfile obtained its packfile.
+type closingRowRepoIter struct {
+	RowRepoIter
+	closer io.Closer
+}
+
+// Close closes both the wrapped iterator and the packfile descriptor.
+func (c *closingRowRepoIter) Close() error {
+	err := c.RowRepoIter.Close()
+
+	if cerr := c.closer.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,67 @@
+package gitbase
+
+import (
+	"testing"
+
+	"gopkg.in/src-d/go-mysql-server.v0/sql"
+)
+
+func TestSinglePackfileNilRepo(t *testing.T) {
+	if _, _, ok := singlePackfile(nil); ok {
+		t.Fatal("singlePackfile(nil) should not find a packfile")
+	}
+
+	if _, _, ok := singlePackfile(&Repository{}); ok {
+		t.Fatal("singlePackfile should not find a packfile on a repo with no Repo set")
+	}
+}
+
+type fakeRowRepoIter struct {
+	newIteratorCalled bool
+	closed            bool
+}
+
+func (f *fakeRowRepoIter) NewIterator(*Repository) (RowRepoIter, error) {
+	f.newIteratorCalled = true
+	return f, nil
+}
+func (f *fakeRowRepoIter) Next() (sql.Row, error) { return nil, nil }
+func (f *fakeRowRepoIter) Close() error           { f.closed = true; return nil }
+
+func TestNewIteratorFallsBackWhenNotPackfileAware(t *testing.T) {
+	iter := &fakeRowRepoIter{}
+	i := &rowRepoIter{iter: iter}
+
+	if _, err := i.newIterator(NewRepository("a", nil)); err != nil {
+		t.Fatalf("newIterator: %v", err)
+	}
+
+	if !iter.newIteratorCalled {
+		t.Fatal("expected NewIterator to be called when the RowRepoIter isn't PackfileAware")
+	}
+}
+
+type fakeCloser struct {
+	closed bool
+}
+
+func (f *fakeCloser) Close() error { f.closed = true; return nil }
+
+func TestClosingRowRepoIterClosesBoth(t *testing.T) {
+	inner := &fakeRowRepoIter{}
+	closer := &fakeCloser{}
+
+	c := &closingRowRepoIter{RowRepoIter: inner, closer: closer}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !inner.closed {
+		t.Error("inner RowRepoIter was not closed")
+	}
+
+	if !closer.closed {
+		t.Error("packfile closer was not closed")
+	}
+}
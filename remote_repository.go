@@ -0,0 +1,357 @@
+package gitbase
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	billy "gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	errors "gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// progressLogger adapts logrus to the io.Writer go-git writes sideband
+// progress lines to during a clone or fetch. Each Write is forwarded as
+// one log entry with its trailing "\r" and "\n" characters trimmed; it's
+// not split further, since go-git already writes one line per Write call.
+type progressLogger struct {
+	id  string
+	url string
+}
+
+// Write implements io.Writer.
+func (p progressLogger) Write(line []byte) (int, error) {
+	logrus.WithFields(logrus.Fields{
+		"id":  p.id,
+		"url": p.url,
+	}).Debug(strings.TrimRight(string(line), "\r\n"))
+
+	return len(line), nil
+}
+
+var (
+	errRemoteCloneFailed = errors.NewKind("could not clone remote repository %s: %s")
+	errRemoteFetchFailed = errors.NewKind("could not fetch remote repository %s: %s")
+	errGitHubAPI         = errors.NewKind("github API request to %s failed with status %s")
+)
+
+// RemoteOptions configures how a remote repository is cloned and kept up
+// to date by AddRemote and friends. Clone and fetch progress is always
+// forwarded to logrus at debug level, tagged with the repository's id
+// and url.
+type RemoteOptions struct {
+	// Auth authenticates clone and fetch operations. Nil means anonymous
+	// access.
+	Auth transport.AuthMethod
+	// Depth limits the fetched commit history to the given number of
+	// commits. Zero means a full clone.
+	Depth int
+	// SingleBranch restricts the clone to the repository's default
+	// branch.
+	SingleBranch bool
+	// RefSpecs overrides the default refspec used when fetching. Empty
+	// means go-git's default.
+	RefSpecs []config.RefSpec
+	// NegotiationTimeout bounds how long a single clone or fetch may
+	// spend talking to the remote before it's aborted. Zero means no
+	// timeout is applied.
+	NegotiationTimeout time.Duration
+	// TTL is the maximum age of a clone before it's re-fetched on next
+	// use. Zero means the repository is cloned once and never refreshed.
+	TTL time.Duration
+}
+
+func (o RemoteOptions) cloneOptions(id, url string) *git.CloneOptions {
+	return &git.CloneOptions{
+		URL:          url,
+		Auth:         o.Auth,
+		Depth:        o.Depth,
+		SingleBranch: o.SingleBranch,
+		Progress:     progressLogger{id: id, url: url},
+	}
+}
+
+func (o RemoteOptions) fetchOptions(id, url string) *git.FetchOptions {
+	opts := &git.FetchOptions{
+		Auth:     o.Auth,
+		Depth:    o.Depth,
+		Progress: progressLogger{id: id, url: url},
+	}
+
+	if len(o.RefSpecs) > 0 {
+		opts.RefSpecs = o.RefSpecs
+	}
+
+	return opts
+}
+
+func (o RemoteOptions) negotiationContext() (context.Context, context.CancelFunc) {
+	if o.NegotiationTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+
+	return context.WithTimeout(context.Background(), o.NegotiationTimeout)
+}
+
+// remoteRepository is a repository implementation backed by a remote git
+// URL. It's cloned into a local cache directory the first time Repo() is
+// called, and optionally re-fetched once its TTL has elapsed.
+type remoteRepository struct {
+	id       string
+	url      string
+	cacheDir string
+	opts     RemoteOptions
+	cloneSF  *singleflight.Group
+
+	mu          sync.Mutex
+	lastFetched time.Time
+}
+
+func remoteRepo(id, url, cacheDir string, opts RemoteOptions, cloneSF *singleflight.Group) repository {
+	return &remoteRepository{
+		id:       id,
+		url:      url,
+		cacheDir: cacheDir,
+		opts:     opts,
+		cloneSF:  cloneSF,
+	}
+}
+
+func (r *remoteRepository) ID() string {
+	return r.id
+}
+
+func (r *remoteRepository) Path() string {
+	return filepath.Join(r.cacheDir, r.id)
+}
+
+func (r *remoteRepository) FS() (billy.Filesystem, error) {
+	if _, err := r.Repo(); err != nil {
+		return nil, err
+	}
+
+	return osfs.New(r.Path()), nil
+}
+
+func (r *remoteRepository) Repo() (*Repository, error) {
+	// Keyed only on r.id, coordination is scoped to this remoteRepository's
+	// own pool via r.cloneSF - two pools registering the same ID under
+	// different URLs or cache dirs never share a singleflight call.
+	v, err, _ := r.cloneSF.Do(r.id, func() (interface{}, error) {
+		return r.cloneOrFetch()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Repository), nil
+}
+
+func (r *remoteRepository) cloneOrFetch() (*Repository, error) {
+	path := r.Path()
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":  r.id,
+			"url": r.url,
+		}).Debug("cloning remote repository")
+
+		ctx, cancel := r.opts.negotiationContext()
+		defer cancel()
+
+		repo, err = git.PlainCloneContext(ctx, path, false, r.opts.cloneOptions(r.id, r.url))
+		if err != nil {
+			return nil, errRemoteCloneFailed.New(r.url, err)
+		}
+
+		r.touch()
+		return NewRepository(r.id, repo), nil
+	}
+
+	if r.expired() {
+		logrus.WithFields(logrus.Fields{
+			"id":  r.id,
+			"url": r.url,
+		}).Debug("re-fetching remote repository")
+
+		ctx, cancel := r.opts.negotiationContext()
+		defer cancel()
+
+		if err := repo.FetchContext(ctx, r.opts.fetchOptions(r.id, r.url)); err != nil &&
+			err != git.NoErrAlreadyUpToDate {
+			return nil, errRemoteFetchFailed.New(r.url, err)
+		}
+
+		r.touch()
+	}
+
+	return NewRepository(r.id, repo), nil
+}
+
+func (r *remoteRepository) expired() bool {
+	if r.opts.TTL <= 0 {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Since(r.lastFetched) > r.opts.TTL
+}
+
+func (r *remoteRepository) touch() {
+	r.mu.Lock()
+	r.lastFetched = time.Now()
+	r.mu.Unlock()
+}
+
+// AddRemote registers a remote git repository under id. It's not cloned
+// until it's first accessed through GetRepo, GetPos or a query plan;
+// clone and fetch failures surface the same way local open failures do,
+// and are skipped rather than aborting a query when the session has
+// SkipGitErrors set.
+func (p *RepositoryPool) AddRemote(id, url string, opts RemoteOptions) error {
+	if p.cloneSF == nil {
+		p.cloneSF = new(singleflight.Group)
+	}
+
+	return p.Add(remoteRepo(id, url, p.remoteCacheDir(), opts, p.cloneSF))
+}
+
+// AddRemoteList reads a newline-delimited list of repository URLs from r
+// and registers each of them with AddRemote. Blank lines and lines
+// starting with '#' are ignored. The repository ID is derived from the
+// URL by stripping its scheme and any trailing ".git" suffix.
+func (p *RepositoryPool) AddRemoteList(r io.Reader, opts RemoteOptions) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url == "" || strings.HasPrefix(url, "#") {
+			continue
+		}
+
+		id := idFromRemoteURL(url)
+		if err := p.AddRemote(id, url, opts); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":    id,
+				"url":   url,
+				"error": err,
+			}).Error("remote repository could not be added")
+		}
+	}
+
+	return scanner.Err()
+}
+
+// githubRepo is the subset of GitHub's repository API response used by
+// AddRemoteGitHubOrg.
+type githubRepo struct {
+	Name     string `json:"name"`
+	CloneURL string `json:"clone_url"`
+}
+
+// AddRemoteGitHubOrg paginates the GitHub API to enumerate every
+// repository in org and registers each of them with AddRemote, using
+// "org/name" as its ID. token, if non-empty, is sent in the Authorization
+// header using the "token" scheme, which both raises the API rate limit and grants access to private
+// repositories the token can see.
+func (p *RepositoryPool) AddRemoteGitHubOrg(org, token string, opts RemoteOptions) error {
+	const perPage = 100
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for page := 1; ; page++ {
+		u := fmt.Sprintf(
+			"https://api.github.com/orgs/%s/repos?per_page=%d&page=%d",
+			org, perPage, page,
+		)
+
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "token "+token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return errGitHubAPI.New(u, resp.Status)
+		}
+
+		var repos []githubRepo
+		err = json.NewDecoder(resp.Body).Decode(&repos)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if len(repos) == 0 {
+			break
+		}
+
+		for _, gr := range repos {
+			id := fmt.Sprintf("%s/%s", org, gr.Name)
+			if err := p.AddRemote(id, gr.CloneURL, opts); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":    id,
+					"url":   gr.CloneURL,
+					"error": err,
+				}).Error("remote repository could not be added")
+			}
+		}
+
+		if len(repos) < perPage {
+			break
+		}
+	}
+
+	return nil
+}
+
+// remoteCacheDir returns the directory remote repositories are cloned
+// into, defaulting to a "gitbase-remotes" directory under the OS temp dir
+// the first time it's needed.
+func (p *RepositoryPool) remoteCacheDir() string {
+	if p.remoteCache == "" {
+		p.remoteCache = filepath.Join(os.TempDir(), "gitbase-remotes")
+	}
+
+	return p.remoteCache
+}
+
+// UseRemoteCacheDir overrides the directory remote repositories are
+// cloned into. It must be called before AddRemote, AddRemoteList or
+// AddRemoteGitHubOrg.
+func (p *RepositoryPool) UseRemoteCacheDir(dir string) {
+	p.remoteCache = dir
+}
+
+func idFromRemoteURL(url string) string {
+	id := strings.TrimSuffix(url, ".git")
+	if i := strings.Index(id, "://"); i >= 0 {
+		id = id[i+3:]
+	}
+
+	return id
+}
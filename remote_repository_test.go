@@ -0,0 +1,47 @@
+package gitbase
+
+import "testing"
+
+func TestIDFromRemoteURL(t *testing.T) {
+	cases := map[string]string{
+		"https://github.com/src-d/gitbase.git": "github.com/src-d/gitbase",
+		"https://github.com/src-d/gitbase":     "github.com/src-d/gitbase",
+		"git@github.com:src-d/gitbase.git":     "git@github.com:src-d/gitbase",
+	}
+
+	for url, want := range cases {
+		if got := idFromRemoteURL(url); got != want {
+			t.Errorf("idFromRemoteURL(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestAddRemoteUsesPerPoolSingleflightGroup(t *testing.T) {
+	a := NewRepositoryPool()
+	b := NewRepositoryPool()
+
+	if err := a.AddRemote("repo", "https://example.com/a.git", RemoteOptions{}); err != nil {
+		t.Fatalf("AddRemote on a: %v", err)
+	}
+
+	if err := b.AddRemote("repo", "https://example.com/b.git", RemoteOptions{}); err != nil {
+		t.Fatalf("AddRemote on b: %v", err)
+	}
+
+	if a.cloneSF == b.cloneSF {
+		t.Fatal("two pools must not share the same singleflight.Group")
+	}
+}
+
+func TestProgressLoggerReportsLinesWritten(t *testing.T) {
+	p := progressLogger{id: "repo", url: "https://example.com/repo.git"}
+
+	n, err := p.Write([]byte("Counting objects: 42% (21/50)\r\n"))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if n != len("Counting objects: 42% (21/50)\r\n") {
+		t.Fatalf("Write returned %d, want the full line length", n)
+	}
+}
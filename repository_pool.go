@@ -1,6 +1,7 @@
 package gitbase
 
 import (
+	"container/list"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/src-d/go-billy-siva.v4"
 	billy "gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/osfs"
@@ -29,6 +31,22 @@ var (
 type Repository struct {
 	ID   string
 	Repo *git.Repository
+
+	// tmpDir, if non-empty, holds a directory that must be removed when
+	// the Repository is no longer needed (e.g. the sivafs temp filesystem
+	// backing a siva repository).
+	tmpDir string
+
+	// closer, if set, overrides Close's default tmpDir-removal behavior.
+	// rootedRepository uses it to release a reference-counted sivaHandle
+	// shared by several logical repositories instead of tearing down a
+	// tmpDir of its own.
+	closer func() error
+
+	// release is set by a repositoryCache when it hands out a handle. It
+	// lets Release give the handle back to the cache instead of closing
+	// it outright.
+	release func()
 }
 
 // NewRepository creates and initializes a new Repository structure
@@ -64,20 +82,53 @@ func NewSivaRepositoryFromPath(id, path string) (*Repository, error) {
 
 	fs, err := sivafs.NewFilesystem(localfs, filepath.Base(path), tmpfs)
 	if err != nil {
+		os.RemoveAll(tmpDir)
 		return nil, err
 	}
 
 	sto, err := filesystem.NewStorage(fs)
 	if err != nil {
+		os.RemoveAll(tmpDir)
 		return nil, err
 	}
 
 	repo, err := git.Open(sto, nil)
 	if err != nil {
+		os.RemoveAll(tmpDir)
 		return nil, err
 	}
 
-	return NewRepository(id, repo), nil
+	r := NewRepository(id, repo)
+	r.tmpDir = tmpDir
+
+	return r, nil
+}
+
+// Release gives the Repository back to the repositoryCache it was
+// obtained from, if any. Once every handle for a given repository ID has
+// been released, the cache is free to evict and close it. Release is a
+// no-op for repositories that were not obtained through a cache.
+func (r *Repository) Release() {
+	if r == nil || r.release == nil {
+		return
+	}
+	r.release()
+}
+
+// Close releases any resources held directly by the Repository, such as
+// the temp directory backing a siva repository's filesystem. It's called
+// by the repositoryCache when a handle is evicted, never by callers
+// holding a cached handle directly - use Release for that.
+func (r *Repository) Close() error {
+	if r.closer != nil {
+		return r.closer()
+	}
+
+	if r.tmpDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(r.tmpDir)
 }
 
 type repository interface {
@@ -151,6 +202,10 @@ func (r *sivaRepository) Path() string {
 type RepositoryPool struct {
 	repositories map[string]repository
 	idOrder      []string
+	cache        *repositoryCache
+	remoteCache  string
+	cloneSF      *singleflight.Group
+	sivaFilter   SivaFilter
 }
 
 // NewRepositoryPool initializes a new RepositoryPool
@@ -160,6 +215,18 @@ func NewRepositoryPool() *RepositoryPool {
 	}
 }
 
+// NewRepositoryPoolWithCache initializes a new RepositoryPool whose
+// GetRepo/GetPos keep up to size open *Repository handles around,
+// reference-counted and evicted least-recently-used first. This avoids
+// repeatedly paying the cost of opening a repository - for siva
+// repositories in particular, that means skipping the tempfs/sivafs setup
+// - when the same ID is requested many times while a query runs.
+func NewRepositoryPoolWithCache(size int) *RepositoryPool {
+	p := NewRepositoryPool()
+	p.cache = newRepositoryCache(size)
+	return p
+}
+
 // Add inserts a new repository in the pool.
 func (p *RepositoryPool) Add(repo repository) error {
 	id := repo.ID()
@@ -222,33 +289,137 @@ func (p *RepositoryPool) AddDir(prefix int, path string) error {
 	return nil
 }
 
-// AddSivaDir adds to the repository pool all siva files found inside the given
-// directory and in its children directories, but not the children of those
-// directories.
+// SivaFilter, if set on a RepositoryPool through UseSivaFilter, is
+// consulted for every siva file discovered by AddSivaDir, AddSivaDirDepth
+// and AddSivaDirGlob. Returning false skips the file.
+type SivaFilter func(path string, info os.FileInfo) bool
+
+// UseSivaFilter installs a filter consulted by AddSivaDir, AddSivaDirDepth
+// and AddSivaDirGlob before a discovered siva file is added to the pool.
+func (p *RepositoryPool) UseSivaFilter(filter SivaFilter) {
+	p.sivaFilter = filter
+}
+
+// AddSivaDir adds to the repository pool all siva files found inside the
+// given directory and in its immediate subdirectories, but not the
+// children of those subdirectories. This is equivalent to
+// AddSivaDirDepth(path, 1).
 func (p *RepositoryPool) AddSivaDir(path string) error {
-	return p.addSivaDir(path, path, true)
+	return p.AddSivaDirDepth(path, 1)
 }
 
-func (p *RepositoryPool) addSivaDir(root, path string, recursive bool) error {
-	dirs, err := ioutil.ReadDir(path)
+// AddSivaDirDepth adds to the repository pool all siva files found under
+// path, descending at most maxDepth directory levels below it. A
+// maxDepth of 0 only looks at files directly inside path; a negative
+// maxDepth removes the limit, walking the whole tree regardless of how
+// deeply the siva files are sharded.
+func (p *RepositoryPool) AddSivaDirDepth(path string, maxDepth int) error {
+	return p.walkSivaDir(path, path, maxDepth)
+}
+
+func (p *RepositoryPool) walkSivaDir(root, path string, depthLeft int) error {
+	entries, err := ioutil.ReadDir(path)
 	if err != nil {
 		return err
 	}
 
-	for _, f := range dirs {
-		if f.IsDir() && recursive {
-			dirPath := filepath.Join(path, f.Name())
-			if err := p.addSivaDir(root, dirPath, false); err != nil {
+	for _, f := range entries {
+		entryPath := filepath.Join(path, f.Name())
+
+		if f.IsDir() {
+			if depthLeft == 0 {
+				continue
+			}
+
+			if err := p.walkSivaDir(root, entryPath, depthLeft-1); err != nil {
 				return err
 			}
-		} else {
-			p.addSivaFile(root, path, f)
+
+			continue
 		}
+
+		p.addSivaFile(root, entryPath, f)
 	}
 
 	return nil
 }
 
+// AddSivaDirGlob adds to the repository pool every siva file under root
+// whose path relative to root matches pattern. pattern is a
+// "/"-separated sequence of filepath.Match components; a component of
+// "**" matches any number of directory levels, including zero, which
+// lets deeply sharded layouts such as "ab/cd/ef/<hash>.siva" be
+// expressed as "**/*.siva".
+func (p *RepositoryPool) AddSivaDirGlob(root string, pattern string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		matched, err := matchSivaGlob(pattern, rel)
+		if err != nil {
+			return err
+		}
+
+		if matched {
+			p.addSivaFile(root, path, info)
+		}
+
+		return nil
+	})
+}
+
+// matchSivaGlob reports whether rel, a path relative to a siva root,
+// matches pattern. Both are split on "/"; each component is matched with
+// filepath.Match except "**", which matches any number of components.
+func matchSivaGlob(pattern, rel string) (bool, error) {
+	return matchGlobParts(
+		strings.Split(filepath.ToSlash(pattern), "/"),
+		strings.Split(filepath.ToSlash(rel), "/"),
+	)
+}
+
+func matchGlobParts(pattern, name []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(name) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return true, nil
+		}
+
+		for i := 0; i <= len(name); i++ {
+			ok, err := matchGlobParts(pattern[1:], name[i:])
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+
+		return false, nil
+	}
+
+	if len(name) == 0 {
+		return false, nil
+	}
+
+	ok, err := filepath.Match(pattern[0], name[0])
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return matchGlobParts(pattern[1:], name[1:])
+}
+
 // AddSivaFile adds to the pool the given file if it's a siva repository,
 // that is, has the .siva extension
 func (p *RepositoryPool) AddSivaFile(id, path string) {
@@ -262,23 +433,52 @@ func (p *RepositoryPool) AddSivaFile(id, path string) {
 }
 
 // addSivaFile adds to the pool the given file if it's a siva repository,
-// that is, has the .siva extension.
+// that is, has the .siva extension. The repository ID is the file's path
+// relative to root with the .siva extension trimmed, so that IDs don't
+// bake in root's absolute path and stay portable across hosts.
 func (p *RepositoryPool) addSivaFile(root, path string, f os.FileInfo) {
-	var relativeFileName string
-	if root == path {
-		relativeFileName = f.Name()
-	} else {
-		relPath := strings.TrimPrefix(strings.Replace(path, root, "", -1), "/\\")
-		relativeFileName = filepath.Join(relPath, f.Name())
+	if !strings.HasSuffix(f.Name(), ".siva") {
+		logrus.WithField("file", path).Warn("found a non-siva file, skipping")
+		return
+	}
+
+	if p.sivaFilter != nil && !p.sivaFilter(path, f) {
+		logrus.WithField("file", path).Debug("repository skipped by filter")
+		return
+	}
+
+	id, err := sivaIDFromPath(root, path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  path,
+			"error": err,
+		}).Error("repository could not be added")
+		return
+	}
+
+	if err := p.Add(sivaRepo(id, path)); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":    id,
+			"file":  path,
+			"error": err,
+		}).Error("repository could not be added")
+		return
 	}
 
-	if strings.HasSuffix(f.Name(), ".siva") {
-		path := filepath.Join(path, f.Name())
-		p.Add(sivaRepo(path, path))
-		logrus.WithField("file", relativeFileName).Debug("repository added")
-	} else {
-		logrus.WithField("file", relativeFileName).Warn("found a non-siva file, skipping")
+	logrus.WithField("file", path).Debug("repository added")
+}
+
+// sivaIDFromPath derives a repository ID from the path of a siva file: its
+// path relative to root, with the .siva extension trimmed. Using a
+// relative path rather than the full absolute path keeps IDs portable
+// across hosts that mount the same siva tree under a different root.
+func sivaIDFromPath(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
 	}
+
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".siva"), nil
 }
 
 // GetPos retrieves a repository at a given position. If the position is
@@ -299,16 +499,125 @@ func (p *RepositoryPool) GetPos(pos int) (*Repository, error) {
 // ErrPoolRepoNotFound is returned when a repository id is not present in the pool.
 var ErrPoolRepoNotFound = errors.NewKind("repository id %s not found in the pool")
 
-// GetRepo returns a repository with the given id from the pool.
+// GetRepo returns a repository with the given id from the pool. If the
+// pool was created with NewRepositoryPoolWithCache, the returned handle
+// may be shared with other callers; call its Release method once it's no
+// longer needed.
 func (p *RepositoryPool) GetRepo(id string) (*Repository, error) {
 	r, ok := p.repositories[id]
 	if !ok {
 		return nil, ErrPoolRepoNotFound.New(id)
 	}
 
+	if p.cache != nil {
+		return p.cache.get(id, r.Repo)
+	}
+
 	return r.Repo()
 }
 
+// repositoryCache is a reference-counted, size-bounded LRU cache of open
+// *Repository handles, keyed by repository ID. Handles with a positive
+// reference count are never evicted; once all references are released,
+// the least-recently-used unreferenced handle is the first to be evicted
+// and closed when the cache grows past its configured size.
+type repositoryCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	index map[string]*list.Element
+}
+
+type repositoryCacheEntry struct {
+	id       string
+	repo     *Repository
+	refCount int
+}
+
+func newRepositoryCache(size int) *repositoryCache {
+	return &repositoryCache{
+		size:  size,
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+// get returns a handle for id, opening it with open if it's not already
+// cached. The handle's Release method must be called exactly once by the
+// caller when it's done using it.
+func (c *repositoryCache) get(
+	id string,
+	open func() (*Repository, error),
+) (*Repository, error) {
+	c.mu.Lock()
+	if el, ok := c.index[id]; ok {
+		entry := el.Value.(*repositoryCacheEntry)
+		entry.refCount++
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return c.handle(entry), nil
+	}
+	c.mu.Unlock()
+
+	repo, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another caller may have populated the entry for id while we were
+	// opening our own handle; prefer the existing one and close ours.
+	if el, ok := c.index[id]; ok {
+		entry := el.Value.(*repositoryCacheEntry)
+		entry.refCount++
+		c.order.MoveToFront(el)
+		repo.Close()
+		return c.handle(entry), nil
+	}
+
+	entry := &repositoryCacheEntry{id: id, repo: repo, refCount: 1}
+	c.index[id] = c.order.PushFront(entry)
+	c.evict()
+
+	return c.handle(entry), nil
+}
+
+// handle returns a shallow copy of entry.repo whose Release method
+// returns the reference to the cache rather than closing the underlying
+// repository directly.
+func (c *repositoryCache) handle(entry *repositoryCacheEntry) *Repository {
+	h := *entry.repo
+	h.release = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		entry.refCount--
+		c.evict()
+	}
+	return &h
+}
+
+// evict closes and removes least-recently-used, unreferenced entries
+// until the cache size is at or below its configured budget. Entries
+// that are still referenced are left in place even if they're the oldest
+// in the cache.
+func (c *repositoryCache) evict() {
+	el := c.order.Back()
+	for el != nil && c.order.Len() > c.size {
+		prev := el.Prev()
+
+		entry := el.Value.(*repositoryCacheEntry)
+		if entry.refCount == 0 {
+			c.order.Remove(el)
+			delete(c.index, entry.id)
+			entry.repo.Close()
+		}
+
+		el = prev
+	}
+}
+
 // RepoIter creates a new Repository iterator
 func (p *RepositoryPool) RepoIter() (*RepositoryIter, error) {
 	iter := &RepositoryIter{
@@ -355,6 +664,7 @@ type iteratorBuilder func(*sql.Context, selectors, []sql.Expression) (RowRepoIte
 type rowRepoIter struct {
 	mu sync.Mutex
 
+	currRepo       *Repository
 	currRepoIter   RowRepoIter
 	repositoryIter *RepositoryIter
 	iter           RowRepoIter
@@ -420,9 +730,12 @@ func (i *rowRepoIter) Next() (sql.Row, error) {
 					return nil, err
 				}
 
-				i.currRepoIter, err = i.iter.NewIterator(repo)
+				i.currRepo = repo
+				i.currRepoIter, err = i.newIterator(repo)
 				if err != nil {
 					if i.session.SkipGitErrors {
+						i.currRepo.Release()
+						i.currRepo = nil
 						continue
 					}
 
@@ -435,6 +748,8 @@ func (i *rowRepoIter) Next() (sql.Row, error) {
 				if err == io.EOF {
 					i.currRepoIter.Close()
 					i.currRepoIter = nil
+					i.currRepo.Release()
+					i.currRepo = nil
 					continue
 				}
 
@@ -450,10 +765,36 @@ func (i *rowRepoIter) Next() (sql.Row, error) {
 	}
 }
 
+// newIterator creates the RowRepoIter used to scan repo. When the
+// configured RowRepoIter implements PackfileAware and repo's object
+// storage is backed by a single packfile, it's given the chance to
+// return a packfile-order iterator instead of the regular per-object
+// path; any setup failure there falls back to NewIterator rather than
+// failing the whole scan.
+func (i *rowRepoIter) newIterator(repo *Repository) (RowRepoIter, error) {
+	if pa, ok := i.iter.(PackfileAware); ok {
+		if pf, closer, ok := singlePackfile(repo); ok {
+			it, err := pa.NewPackfileIterator(pf, repo)
+			if err == nil {
+				return &closingRowRepoIter{RowRepoIter: it, closer: closer}, nil
+			}
+
+			closer.Close()
+			logrus.WithFields(logrus.Fields{
+				"id":    repo.ID,
+				"error": err,
+			}).Debug("packfile iterator setup failed, falling back to per-object scan")
+		}
+	}
+
+	return i.iter.NewIterator(repo)
+}
+
 // Close called to close the iterator
 func (i *rowRepoIter) Close() error {
 	if i.currRepoIter != nil {
 		i.currRepoIter.Close()
 	}
+	i.currRepo.Release()
 	return i.iter.Close()
 }
@@ -0,0 +1,108 @@
+package gitbase
+
+import "testing"
+
+func TestRepositoryCacheReusesHandleUntilReleased(t *testing.T) {
+	c := newRepositoryCache(2)
+
+	opens := 0
+	open := func() (*Repository, error) {
+		opens++
+		return NewRepository("a", nil), nil
+	}
+
+	h1, err := c.get("a", open)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	h2, err := c.get("a", open)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if opens != 1 {
+		t.Fatalf("expected 1 open, got %d", opens)
+	}
+
+	h1.Release()
+	h2.Release()
+
+	if _, err := c.get("a", open); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if opens != 1 {
+		t.Fatalf("expected the still-cached entry to be reused, got %d opens", opens)
+	}
+}
+
+func TestRepositoryCacheEvictsOnlyUnreferencedEntries(t *testing.T) {
+	c := newRepositoryCache(1)
+
+	open := func(id string) func() (*Repository, error) {
+		return func() (*Repository, error) { return NewRepository(id, nil), nil }
+	}
+
+	a, err := c.get("a", open("a"))
+	if err != nil {
+		t.Fatalf("get a: %v", err)
+	}
+
+	// "a" is still referenced, so adding "b" must not evict it even
+	// though the cache size is 1.
+	if _, err := c.get("b", open("b")); err != nil {
+		t.Fatalf("get b: %v", err)
+	}
+
+	if _, ok := c.index["a"]; !ok {
+		t.Fatal("referenced entry \"a\" was evicted")
+	}
+
+	a.Release()
+
+	// Now that "a" has no references left, the next eviction pass should
+	// be able to reclaim it to respect the size budget.
+	if _, err := c.get("c", open("c")); err != nil {
+		t.Fatalf("get c: %v", err)
+	}
+
+	if _, ok := c.index["a"]; ok {
+		t.Fatal("unreferenced entry \"a\" should have been evicted")
+	}
+}
+
+func TestSivaIDFromPath(t *testing.T) {
+	id, err := sivaIDFromPath("/repos", "/repos/ab/cd/ef/deadbeef.siva")
+	if err != nil {
+		t.Fatalf("sivaIDFromPath: %v", err)
+	}
+
+	if want := "ab/cd/ef/deadbeef"; id != want {
+		t.Fatalf("id = %q, want %q", id, want)
+	}
+}
+
+func TestMatchSivaGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"**/*.siva", "ab/cd/ef/deadbeef.siva", true},
+		{"**/*.siva", "deadbeef.siva", true},
+		{"*.siva", "ab/deadbeef.siva", false},
+		{"*.siva", "deadbeef.siva", true},
+	}
+
+	for _, c := range cases {
+		got, err := matchSivaGlob(c.pattern, c.rel)
+		if err != nil {
+			t.Fatalf("matchSivaGlob(%q, %q): %v", c.pattern, c.rel, err)
+		}
+
+		if got != c.want {
+			t.Errorf("matchSivaGlob(%q, %q) = %v, want %v", c.pattern, c.rel, got, c.want)
+		}
+	}
+}
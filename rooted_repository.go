@@ -0,0 +1,315 @@
+package gitbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-billy-siva.v4"
+	billy "gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	errors "gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+var errRootedSivaNoRoots = errors.NewKind("siva file %s has no rooted repositories")
+
+// rootedRefPrefix is the reference namespace borges uses to bundle the
+// history of several upstream remotes inside a single siva file, one
+// root per init-commit hash: refs/remotes/<init-hash>/*.
+const rootedRefPrefix = "refs/remotes/"
+
+// sivaHandle is the siva storage shared by every rootedRepository derived
+// from the same file. It's opened at most once, when AddRootedSiva
+// enumerates its roots, so the tempdir/sivafs setup that
+// NewSivaRepositoryFromPath normally pays per logical repository is only
+// paid once per file.
+type sivaHandle struct {
+	path string
+
+	mu       sync.Mutex
+	opened   bool
+	repo     *git.Repository
+	fs       billy.Filesystem
+	refs     map[string][]*plumbing.Reference // init-hash -> its refs
+	tmpDir   string
+	refCount int
+}
+
+func (h *sivaHandle) open() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.opened {
+		return nil
+	}
+
+	localfs := osfs.New(filepath.Dir(h.path))
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "gitbase-siva")
+	if err != nil {
+		return err
+	}
+
+	tmpfs := osfs.New(tmpDir)
+
+	fs, err := sivafs.NewFilesystem(localfs, filepath.Base(h.path), tmpfs)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	sto, err := filesystem.NewStorage(fs)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	repo, err := git.Open(sto, nil)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	refs, err := rootedRefsByInitHash(repo.Storer)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	h.fs = fs
+	h.repo = repo
+	h.refs = refs
+	h.tmpDir = tmpDir
+	h.opened = true
+
+	return nil
+}
+
+// acquire registers one more user of the handle's shared resources (the
+// sivafs tempdir in particular). Every acquire must be paired with a
+// release.
+func (h *sivaHandle) acquire() {
+	h.mu.Lock()
+	h.refCount++
+	h.mu.Unlock()
+}
+
+// release drops one reference to the handle's resources, removing its
+// tempdir once every root that acquired it has released it in turn. It's
+// wired as the Close method of every *Repository returned by
+// rootedRepository.Repo, so a single root being evicted from a
+// repositoryCache never tears down the filesystem still backing its
+// siblings.
+func (h *sivaHandle) release() error {
+	h.mu.Lock()
+	h.refCount--
+	remaining := h.refCount
+	tmpDir := h.tmpDir
+	h.mu.Unlock()
+
+	if remaining > 0 || tmpDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(tmpDir)
+}
+
+// roots returns the init-hash of every rooted repository found in the
+// siva file, opening it if this is the first call.
+func (h *sivaHandle) roots() ([]string, error) {
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	roots := make([]string, 0, len(h.refs))
+	for hash := range h.refs {
+		roots = append(roots, hash)
+	}
+
+	return roots, nil
+}
+
+func rootedRefsByInitHash(sto storage.Storer) (map[string][]*plumbing.Reference, error) {
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	refs := make(map[string][]*plumbing.Reference)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		rest := strings.TrimPrefix(ref.Name().String(), rootedRefPrefix)
+		if rest == ref.Name().String() {
+			// not under refs/remotes/, not a rooted ref
+			return nil
+		}
+
+		parts := strings.SplitN(rest, "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+
+		initHash := parts[0]
+		refs[initHash] = append(refs[initHash], ref)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// rootedStorer wraps the storage.Storer shared by every root of a siva
+// file, restricting the references it exposes to those belonging to a
+// single init-hash. Object lookups are left untouched, since the
+// reachable graphs of every root in the same file still live in the same
+// packed storage.
+type rootedStorer struct {
+	storage.Storer
+	refs []*plumbing.Reference
+}
+
+// Reference implements storer.ReferenceStorer.
+func (s *rootedStorer) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	for _, ref := range s.refs {
+		if ref.Name() == name {
+			return ref, nil
+		}
+	}
+
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+// IterReferences implements storer.ReferenceStorer.
+func (s *rootedStorer) IterReferences() (storer.ReferenceIter, error) {
+	return storer.NewReferenceSliceIter(s.refs), nil
+}
+
+// rootedRepository is a repository implementation that exposes a single
+// logical repository out of a siva file that may bundle the history of
+// several upstream remotes together, one per init-commit hash. Its
+// References() only see the refs belonging to its own root. Object
+// access is not filtered: CommitObjects() and the other object iterators
+// see every object stored in the siva file, including those reachable
+// only from other roots.
+type rootedRepository struct {
+	id       string
+	path     string
+	initHash string
+	handle   *sivaHandle
+}
+
+func (r *rootedRepository) ID() string {
+	return r.id
+}
+
+func (r *rootedRepository) Path() string {
+	return r.path
+}
+
+func (r *rootedRepository) Repo() (*Repository, error) {
+	if err := r.handle.open(); err != nil {
+		return nil, err
+	}
+
+	r.handle.acquire()
+
+	r.handle.mu.Lock()
+	refs := r.handle.refs[r.initHash]
+	sto := &rootedStorer{Storer: r.handle.repo.Storer, refs: refs}
+	r.handle.mu.Unlock()
+
+	repo, err := git.Open(sto, nil)
+	if err != nil {
+		r.handle.release()
+		return nil, err
+	}
+
+	out := NewRepository(r.id, repo)
+	out.closer = r.handle.release
+
+	return out, nil
+}
+
+func (r *rootedRepository) FS() (billy.Filesystem, error) {
+	if err := r.handle.open(); err != nil {
+		return nil, err
+	}
+
+	r.handle.mu.Lock()
+	defer r.handle.mu.Unlock()
+
+	return r.handle.fs, nil
+}
+
+// AddRootedSiva opens the siva file at path once and registers one
+// logical repository per init-commit hash found among its
+// "refs/remotes/<init-hash>/*" references, each with its own ID and a
+// view whose references are filtered to that root's refs; objects are
+// not filtered (see rootedRepository).
+// Every repository registered this way shares the same underlying siva
+// filesystem and storage, each Repo call opening its own git.Repository
+// over a filtered view of it, so the tempdir/sivafs setup cost in
+// NewSivaRepositoryFromPath is paid once per file rather than once per
+// logical repository.
+//
+// As with AddSivaDir and friends, root anchors the portion of path used
+// to derive IDs: each logical repository's ID is path's location
+// relative to root, with the .siva extension trimmed, plus its
+// init-hash. This keeps IDs unique across siva files that share a
+// basename under different shards, and portable across hosts.
+func (p *RepositoryPool) AddRootedSiva(root, path string) error {
+	handle := &sivaHandle{path: path}
+
+	roots, err := handle.roots()
+	if err != nil {
+		return err
+	}
+
+	if len(roots) == 0 {
+		return errRootedSivaNoRoots.New(path)
+	}
+
+	base, err := sivaIDFromPath(root, path)
+	if err != nil {
+		return err
+	}
+
+	for _, initHash := range roots {
+		id := base + "/" + initHash
+
+		err := p.Add(&rootedRepository{
+			id:       id,
+			path:     path,
+			initHash: initHash,
+			handle:   handle,
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":    id,
+				"file":  path,
+				"error": err,
+			}).Error("rooted repository could not be added")
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"id":   id,
+			"file": path,
+		}).Debug("rooted repository added")
+	}
+
+	return nil
+}
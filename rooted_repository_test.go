@@ -0,0 +1,73 @@
+package gitbase
+
+import (
+	"os"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// fakeRefStorer implements just enough of storage.Storer to exercise
+// rootedRefsByInitHash; every other method is inherited from the nil
+// embedded Storer and must not be called by the code under test.
+type fakeRefStorer struct {
+	storage.Storer
+	refs []*plumbing.Reference
+}
+
+func (s *fakeRefStorer) IterReferences() (storer.ReferenceIter, error) {
+	return storer.NewReferenceSliceIter(s.refs), nil
+}
+
+func TestRootedRefsByInitHashGroupsByRoot(t *testing.T) {
+	sto := &fakeRefStorer{
+		refs: []*plumbing.Reference{
+			plumbing.NewHashReference("refs/remotes/aaaa/master", plumbing.ZeroHash),
+			plumbing.NewHashReference("refs/remotes/aaaa/branch", plumbing.ZeroHash),
+			plumbing.NewHashReference("refs/remotes/bbbb/master", plumbing.ZeroHash),
+			plumbing.NewHashReference("refs/heads/master", plumbing.ZeroHash),
+		},
+	}
+
+	refs, err := rootedRefsByInitHash(sto)
+	if err != nil {
+		t.Fatalf("rootedRefsByInitHash: %v", err)
+	}
+
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 roots, got %d", len(refs))
+	}
+
+	if len(refs["aaaa"]) != 2 {
+		t.Fatalf("expected 2 refs under root aaaa, got %d", len(refs["aaaa"]))
+	}
+
+	if len(refs["bbbb"]) != 1 {
+		t.Fatalf("expected 1 ref under root bbbb, got %d", len(refs["bbbb"]))
+	}
+}
+
+func TestSivaHandleReleasesOnlyWhenEveryAcquirerIsDone(t *testing.T) {
+	h := &sivaHandle{tmpDir: t.TempDir()}
+
+	h.acquire()
+	h.acquire()
+
+	if err := h.release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	if _, err := os.Stat(h.tmpDir); err != nil {
+		t.Fatalf("tmpDir should still exist while a reference remains: %v", err)
+	}
+
+	if err := h.release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	if _, err := os.Stat(h.tmpDir); err == nil {
+		t.Fatal("tmpDir should have been removed once every reference was released")
+	}
+}
@@ -0,0 +1,38 @@
+package gitbase
+
+import (
+	errors "gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-mysql-server.v0/sql"
+)
+
+// ErrInvalidGitbaseSession is returned whenever a *sql.Context is used
+// against gitbase's tables and functions without carrying a *Session.
+var ErrInvalidGitbaseSession = errors.NewKind("expecting gitbase session, got %T")
+
+// Session is the sql.Session implementation every gitbase query runs
+// with. It carries the RepositoryPool a query plan iterates over, plus
+// any per-query state gitbase's tables and functions need to share.
+type Session struct {
+	sql.Session
+
+	Pool *RepositoryPool
+
+	// SkipGitErrors, when set, makes repository iterators skip over
+	// repositories that fail to open, and rows that fail to be read,
+	// instead of aborting the whole query.
+	SkipGitErrors bool
+
+	// astCache holds the UAST nodes produced for this session by
+	// uast_mode, so repeated calls against the same blob don't re-invoke
+	// the bblfsh driver. uast_xpath and uast_extract work on already
+	// marshaled nodes and never parse.
+	astCache *astCache
+}
+
+// NewSession creates a new gitbase Session wrapping pool.
+func NewSession(pool *RepositoryPool) *Session {
+	return &Session{
+		Session: sql.NewBaseSession(),
+		Pool:    pool,
+	}
+}
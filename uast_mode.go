@@ -0,0 +1,710 @@
+package gitbase
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/bblfsh/sdk.v2/driver"
+	"gopkg.in/bblfsh/sdk.v2/uast/nodes"
+	errors "gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-mysql-server.v0/sql"
+)
+
+var (
+	errInvalidUASTNode = errors.NewKind("invalid uast node blob")
+	errInvalidUASTKey  = errors.NewKind("uast node has no field %q")
+)
+
+// astCacheKey identifies a single parsed-and-transformed AST so repeated
+// uast_mode calls against the same blob within a query can reuse it
+// instead of re-invoking the bblfsh driver.
+type astCacheKey struct {
+	blobHash string
+	lang     string
+	mode     driver.Mode
+}
+
+// astCache caches nodes.Node values produced by Transforms.Do, keyed by
+// (blob_hash, lang, mode). It's owned by a Session and shared across
+// every uast_mode call evaluated with that Session.
+type astCache struct {
+	mu    sync.Mutex
+	nodes map[astCacheKey]nodes.Node
+}
+
+func newASTCache() *astCache {
+	return &astCache{nodes: make(map[astCacheKey]nodes.Node)}
+}
+
+func (c *astCache) get(key astCacheKey) (nodes.Node, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nd, ok := c.nodes[key]
+	return nd, ok
+}
+
+func (c *astCache) put(key astCacheKey, nd nodes.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[key] = nd
+}
+
+func blobHash(blob []byte) string {
+	sum := sha1.Sum(blob)
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionASTCache returns the astCache owned by ctx's Session, creating
+// one on first use.
+func sessionASTCache(ctx *sql.Context) (*astCache, error) {
+	s, ok := ctx.Session.(*Session)
+	if !ok || s == nil {
+		return nil, ErrInvalidGitbaseSession.New(ctx.Session)
+	}
+
+	if s.astCache == nil {
+		s.astCache = newASTCache()
+	}
+
+	return s.astCache, nil
+}
+
+// UASTMode implements the uast_mode(blob, lang, mode, [xpath]) function.
+// Unlike uast, which always runs the driver's default transformation
+// pipeline, it threads mode straight through to Transforms.Do so callers
+// can request the native, annotated or semantic AST explicitly.
+type UASTMode struct {
+	Blob  sql.Expression
+	Lang  sql.Expression
+	Mode  sql.Expression
+	XPath sql.Expression
+}
+
+// NewUASTMode creates a new UASTMode function. xpath may be nil.
+func NewUASTMode(blob, lang, mode, xpath sql.Expression) sql.Expression {
+	return &UASTMode{Blob: blob, Lang: lang, Mode: mode, XPath: xpath}
+}
+
+// Children implements sql.Expression.
+func (f *UASTMode) Children() []sql.Expression {
+	children := []sql.Expression{f.Blob, f.Lang, f.Mode}
+	if f.XPath != nil {
+		children = append(children, f.XPath)
+	}
+	return children
+}
+
+// Resolved implements sql.Expression.
+func (f *UASTMode) Resolved() bool {
+	for _, c := range f.Children() {
+		if !c.Resolved() {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNullable implements sql.Expression.
+func (f *UASTMode) IsNullable() bool { return true }
+
+// Type implements sql.Expression.
+func (f *UASTMode) Type() sql.Type { return sql.Blob }
+
+// String implements sql.Expression.
+func (f *UASTMode) String() string {
+	if f.XPath == nil {
+		return fmt.Sprintf("uast_mode(%s, %s, %s)", f.Blob, f.Lang, f.Mode)
+	}
+	return fmt.Sprintf("uast_mode(%s, %s, %s, %s)", f.Blob, f.Lang, f.Mode, f.XPath)
+}
+
+// TransformUp implements sql.Expression.
+func (f *UASTMode) TransformUp(fn sql.TransformExprFunc) (sql.Expression, error) {
+	blob, err := f.Blob.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	lang, err := f.Lang.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := f.Mode.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var xpath sql.Expression
+	if f.XPath != nil {
+		xpath, err = f.XPath.TransformUp(fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fn(NewUASTMode(blob, lang, mode, xpath))
+}
+
+// Eval implements sql.Expression.
+func (f *UASTMode) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	blob, lang, modeStr, xpath, err := evalUASTModeArgs(ctx, row, f.Blob, f.Lang, f.Mode, f.XPath)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+
+	mode, err := driver.ParseMode(modeStr)
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := parseAndTransform(ctx, blob, lang, mode)
+	if err != nil || nd == nil {
+		return nil, err
+	}
+
+	if xpath != "" {
+		return marshalNodes(filterXPath(nd, xpath))
+	}
+
+	return marshalNode(nd)
+}
+
+// evalUASTModeArgs evaluates the shared blob/lang/mode/xpath arguments
+// used by uast_mode. A nil blob means the row should evaluate to NULL.
+func evalUASTModeArgs(
+	ctx *sql.Context,
+	row sql.Row,
+	blobExpr, langExpr, modeExpr, xpathExpr sql.Expression,
+) (blob []byte, lang, mode, xpath string, err error) {
+	v, err := blobExpr.Eval(ctx, row)
+	if err != nil || v == nil {
+		return nil, "", "", "", err
+	}
+
+	blob, ok := v.([]byte)
+	if !ok {
+		return nil, "", "", "", errInvalidUASTNode.New()
+	}
+
+	if langExpr != nil {
+		v, err = langExpr.Eval(ctx, row)
+		if err != nil {
+			return nil, "", "", "", err
+		}
+		if v != nil {
+			lang, _ = v.(string)
+		}
+	}
+
+	v, err = modeExpr.Eval(ctx, row)
+	if err != nil {
+		return nil, "", "", "", err
+	}
+	if s, ok := v.(string); ok {
+		mode = s
+	}
+
+	if xpathExpr != nil {
+		v, err = xpathExpr.Eval(ctx, row)
+		if err != nil {
+			return nil, "", "", "", err
+		}
+		if s, ok := v.(string); ok {
+			xpath = s
+		}
+	}
+
+	return blob, lang, mode, xpath, nil
+}
+
+// parseAndTransform runs the bblfsh driver transform pipeline for blob in
+// the given language and mode, reusing a cached result keyed on
+// (blob_hash, lang, mode) when one is available on ctx's Session.
+func parseAndTransform(ctx *sql.Context, blob []byte, lang string, mode driver.Mode) (nodes.Node, error) {
+	cache, err := sessionASTCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := astCacheKey{blobHash: blobHash(blob), lang: lang, mode: mode}
+	if nd, ok := cache.get(key); ok {
+		return nd, nil
+	}
+
+	nd, err := parseUASTBlob(ctx, blob, lang, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.put(key, nd)
+	return nd, nil
+}
+
+// uast_children(node) returns the marshaled direct children of a
+// previously marshaled UAST node.
+type UASTChildren struct {
+	Node sql.Expression
+}
+
+// NewUASTChildren creates a new UASTChildren function.
+func NewUASTChildren(node sql.Expression) sql.Expression {
+	return &UASTChildren{Node: node}
+}
+
+// Children implements sql.Expression.
+func (f *UASTChildren) Children() []sql.Expression { return []sql.Expression{f.Node} }
+
+// Resolved implements sql.Expression.
+func (f *UASTChildren) Resolved() bool { return f.Node.Resolved() }
+
+// IsNullable implements sql.Expression.
+func (f *UASTChildren) IsNullable() bool { return true }
+
+// Type implements sql.Expression.
+func (f *UASTChildren) Type() sql.Type { return sql.Blob }
+
+// String implements sql.Expression.
+func (f *UASTChildren) String() string { return fmt.Sprintf("uast_children(%s)", f.Node) }
+
+// TransformUp implements sql.Expression.
+func (f *UASTChildren) TransformUp(fn sql.TransformExprFunc) (sql.Expression, error) {
+	node, err := f.Node.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+	return fn(NewUASTChildren(node))
+}
+
+// Eval implements sql.Expression.
+func (f *UASTChildren) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	nd, err := evalMarshaledNode(ctx, row, f.Node)
+	if err != nil || nd == nil {
+		return nil, err
+	}
+
+	obj, ok := nd.(nodes.Object)
+	if !ok {
+		return marshalNodes(nil)
+	}
+
+	return marshalNodes(childrenOf(obj))
+}
+
+// uast_xpath(node, query) filters a previously marshaled UAST node with
+// an XPath query, returning the matches as a marshaled node array.
+type UASTXPath struct {
+	Node  sql.Expression
+	Query sql.Expression
+}
+
+// NewUASTXPath creates a new UASTXPath function.
+func NewUASTXPath(node, query sql.Expression) sql.Expression {
+	return &UASTXPath{Node: node, Query: query}
+}
+
+// Children implements sql.Expression.
+func (f *UASTXPath) Children() []sql.Expression { return []sql.Expression{f.Node, f.Query} }
+
+// Resolved implements sql.Expression.
+func (f *UASTXPath) Resolved() bool { return f.Node.Resolved() && f.Query.Resolved() }
+
+// IsNullable implements sql.Expression.
+func (f *UASTXPath) IsNullable() bool { return true }
+
+// Type implements sql.Expression.
+func (f *UASTXPath) Type() sql.Type { return sql.Blob }
+
+// String implements sql.Expression.
+func (f *UASTXPath) String() string { return fmt.Sprintf("uast_xpath(%s, %s)", f.Node, f.Query) }
+
+// TransformUp implements sql.Expression.
+func (f *UASTXPath) TransformUp(fn sql.TransformExprFunc) (sql.Expression, error) {
+	node, err := f.Node.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := f.Query.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return fn(NewUASTXPath(node, query))
+}
+
+// Eval implements sql.Expression.
+func (f *UASTXPath) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	nd, err := evalMarshaledNode(ctx, row, f.Node)
+	if err != nil || nd == nil {
+		return nil, err
+	}
+
+	v, err := f.Query.Eval(ctx, row)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	query, ok := v.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	return marshalNodes(filterXPath(nd, query))
+}
+
+// uast_extract(node, key) extracts a single field from a previously
+// marshaled UAST node.
+type UASTExtract struct {
+	Node sql.Expression
+	Key  sql.Expression
+}
+
+// NewUASTExtract creates a new UASTExtract function.
+func NewUASTExtract(node, key sql.Expression) sql.Expression {
+	return &UASTExtract{Node: node, Key: key}
+}
+
+// Children implements sql.Expression.
+func (f *UASTExtract) Children() []sql.Expression { return []sql.Expression{f.Node, f.Key} }
+
+// Resolved implements sql.Expression.
+func (f *UASTExtract) Resolved() bool { return f.Node.Resolved() && f.Key.Resolved() }
+
+// IsNullable implements sql.Expression.
+func (f *UASTExtract) IsNullable() bool { return true }
+
+// Type implements sql.Expression.
+func (f *UASTExtract) Type() sql.Type { return sql.Text }
+
+// String implements sql.Expression.
+func (f *UASTExtract) String() string { return fmt.Sprintf("uast_extract(%s, %s)", f.Node, f.Key) }
+
+// TransformUp implements sql.Expression.
+func (f *UASTExtract) TransformUp(fn sql.TransformExprFunc) (sql.Expression, error) {
+	node, err := f.Node.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := f.Key.TransformUp(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return fn(NewUASTExtract(node, key))
+}
+
+// Eval implements sql.Expression.
+func (f *UASTExtract) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	nd, err := evalMarshaledNode(ctx, row, f.Node)
+	if err != nil || nd == nil {
+		return nil, err
+	}
+
+	v, err := f.Key.Eval(ctx, row)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	key, ok := v.(string)
+	if !ok {
+		return nil, nil
+	}
+
+	obj, ok := nd.(nodes.Object)
+	if !ok {
+		return nil, errInvalidUASTKey.New(key)
+	}
+
+	field, ok := obj[key]
+	if !ok {
+		return nil, errInvalidUASTKey.New(key)
+	}
+
+	return fmt.Sprintf("%v", field), nil
+}
+
+// evalMarshaledNode evaluates expr and unmarshals it as a previously
+// marshaled UAST node.
+func evalMarshaledNode(ctx *sql.Context, row sql.Row, expr sql.Expression) (nodes.Node, error) {
+	v, err := expr.Eval(ctx, row)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	blob, ok := v.([]byte)
+	if !ok {
+		return nil, errInvalidUASTNode.New()
+	}
+
+	return unmarshalNode(blob)
+}
+
+// childrenOf returns the direct child nodes of obj in a stable order: its
+// fields are visited sorted by name, since nodes.Object is a Go map and
+// would otherwise iterate in a different, randomized order on every call.
+func childrenOf(obj nodes.Object) []nodes.Node {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var children []nodes.Node
+	for _, k := range keys {
+		switch n := obj[k].(type) {
+		case nodes.Object:
+			children = append(children, n)
+		case nodes.Array:
+			for _, item := range n {
+				children = append(children, item)
+			}
+		}
+	}
+	return children
+}
+
+var (
+	errNoUASTParser     = errors.NewKind("no UAST native parser registered for language %q")
+	errNoUASTTransforms = errors.NewKind("no UAST transforms registered for language %q")
+)
+
+// NativeParser turns a blob written in some language into the native AST
+// its bblfsh driver produces, before any Transforms.Do normalization or
+// annotation is applied. Driver integrations register one per language
+// through RegisterUASTNativeParser, typically wrapping their bblfsh
+// client's Parse call.
+type NativeParser func(ctx context.Context, blob []byte) (nodes.Node, error)
+
+// nativeParsersByLang holds the NativeParser a driver integration
+// registers for a language through RegisterUASTNativeParser.
+// parseUASTBlob consults it to obtain the native AST every mode is built
+// from.
+var nativeParsersByLang = map[string]NativeParser{}
+
+// RegisterUASTNativeParser registers the parser used to turn a blob
+// written in lang into its native AST. Driver integrations call this
+// during setup; uast_mode fails with errNoUASTParser for languages with
+// nothing registered, for every mode including ModeNative.
+func RegisterUASTNativeParser(lang string, parse NativeParser) {
+	nativeParsersByLang[lang] = parse
+}
+
+// transformsByLang holds the Transforms pipeline a driver integration
+// registers for a language through RegisterUASTTransforms. parseUASTBlob
+// consults it to produce annotated/semantic ASTs out of the native AST;
+// without an entry, only ModeNative is available.
+var transformsByLang = map[string]driver.Transforms{}
+
+// RegisterUASTTransforms registers the Transforms pipeline used to turn a
+// blob written in lang into an annotated or semantic UAST. Driver
+// integrations call this during setup; uast_mode fails with
+// errNoUASTTransforms for languages with nothing registered, except in
+// ModeNative, which never needs a pipeline.
+func RegisterUASTTransforms(lang string, t driver.Transforms) {
+	transformsByLang[lang] = t
+}
+
+// parseUASTBlob parses blob's content into its native AST using the
+// NativeParser registered for lang and, unless mode is ModeNative, runs
+// the result through the Transforms pipeline registered for lang.
+func parseUASTBlob(ctx *sql.Context, blob []byte, lang string, mode driver.Mode) (nodes.Node, error) {
+	parse, ok := nativeParsersByLang[lang]
+	if !ok {
+		return nil, errNoUASTParser.New(lang)
+	}
+
+	nd, err := parse(context.Background(), blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == driver.ModeNative {
+		return nd, nil
+	}
+
+	t, ok := transformsByLang[lang]
+	if !ok {
+		return nil, errNoUASTTransforms.New(lang)
+	}
+
+	return t.Do(context.Background(), mode, string(blob), nd)
+}
+
+// marshalNode serializes a single UAST node to the blob format returned
+// by uast_mode.
+func marshalNode(nd nodes.Node) ([]byte, error) {
+	return json.Marshal(nodeToInterface(nd))
+}
+
+// marshalNodes serializes a slice of UAST nodes to the blob format
+// returned by uast_children and uast_xpath.
+func marshalNodes(nds []nodes.Node) ([]byte, error) {
+	vs := make([]interface{}, len(nds))
+	for i, nd := range nds {
+		vs[i] = nodeToInterface(nd)
+	}
+	return json.Marshal(vs)
+}
+
+// unmarshalNode parses a blob previously produced by marshalNode back
+// into a nodes.Node.
+func unmarshalNode(blob []byte) (nodes.Node, error) {
+	var v interface{}
+	if err := json.Unmarshal(blob, &v); err != nil {
+		return nil, err
+	}
+	return interfaceToNode(v), nil
+}
+
+// nodeToInterface converts a nodes.Node into the plain map/slice/scalar
+// values encoding/json knows how to marshal.
+func nodeToInterface(nd nodes.Node) interface{} {
+	switch n := nd.(type) {
+	case nil:
+		return nil
+	case nodes.Object:
+		m := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			m[k] = nodeToInterface(v)
+		}
+		return m
+	case nodes.Array:
+		a := make([]interface{}, len(n))
+		for i, v := range n {
+			a[i] = nodeToInterface(v)
+		}
+		return a
+	case nodes.String:
+		return string(n)
+	case nodes.Int:
+		return int64(n)
+	case nodes.Uint:
+		return uint64(n)
+	case nodes.Float:
+		return float64(n)
+	case nodes.Bool:
+		return bool(n)
+	default:
+		return fmt.Sprintf("%v", n)
+	}
+}
+
+// interfaceToNode converts a value produced by encoding/json.Unmarshal
+// back into a nodes.Node. It reverses nodeToInterface except for
+// numbers: JSON numbers decode as float64, so nodes.Int and nodes.Uint
+// values come back as nodes.Float.
+func interfaceToNode(v interface{}) nodes.Node {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		obj := make(nodes.Object, len(x))
+		for k, val := range x {
+			obj[k] = interfaceToNode(val)
+		}
+		return obj
+	case []interface{}:
+		arr := make(nodes.Array, len(x))
+		for i, val := range x {
+			arr[i] = interfaceToNode(val)
+		}
+		return arr
+	case string:
+		return nodes.String(x)
+	case float64:
+		return nodes.Float(x)
+	case bool:
+		return nodes.Bool(x)
+	default:
+		return nodes.String(fmt.Sprintf("%v", x))
+	}
+}
+
+// filterXPath returns every node in root whose "@type" field equals the
+// type name in query, which must be of the form "//TypeName". This
+// covers the common "find every node of type X" query; it's a narrow
+// subset of XPath, not a general implementation.
+func filterXPath(root nodes.Node, query string) []nodes.Node {
+	typ := strings.TrimPrefix(query, "//")
+
+	var matches []nodes.Node
+	var walk func(nd nodes.Node)
+	walk = func(nd nodes.Node) {
+		switch n := nd.(type) {
+		case nodes.Object:
+			if t, ok := n["@type"]; ok {
+				if s, ok := t.(nodes.String); ok && string(s) == typ {
+					matches = append(matches, n)
+				}
+			}
+			for _, v := range n {
+				walk(v)
+			}
+		case nodes.Array:
+			for _, v := range n {
+				walk(v)
+			}
+		}
+	}
+
+	walk(root)
+	return matches
+}
+
+var errFunctionArity = errors.NewKind("function %q expects %s, got %d argument(s)")
+
+// Function describes a gitbase SQL function: its name and how to build
+// the sql.Expression that implements a call to it.
+type Function struct {
+	Name  string
+	Build func(args ...sql.Expression) (sql.Expression, error)
+}
+
+// Functions lists every SQL function added by this file, ready to be
+// registered with the engine's function catalog.
+var Functions = []Function{
+	{Name: "uast_mode", Build: buildUASTMode},
+	{Name: "uast_children", Build: buildUASTChildren},
+	{Name: "uast_xpath", Build: buildUASTXPath},
+	{Name: "uast_extract", Build: buildUASTExtract},
+}
+
+func buildUASTMode(args ...sql.Expression) (sql.Expression, error) {
+	switch len(args) {
+	case 3:
+		return NewUASTMode(args[0], args[1], args[2], nil), nil
+	case 4:
+		return NewUASTMode(args[0], args[1], args[2], args[3]), nil
+	default:
+		return nil, errFunctionArity.New("uast_mode", "3 or 4", len(args))
+	}
+}
+
+func buildUASTChildren(args ...sql.Expression) (sql.Expression, error) {
+	if len(args) != 1 {
+		return nil, errFunctionArity.New("uast_children", "1", len(args))
+	}
+	return NewUASTChildren(args[0]), nil
+}
+
+func buildUASTXPath(args ...sql.Expression) (sql.Expression, error) {
+	if len(args) != 2 {
+		return nil, errFunctionArity.New("uast_xpath", "2", len(args))
+	}
+	return NewUASTXPath(args[0], args[1]), nil
+}
+
+func buildUASTExtract(args ...sql.Expression) (sql.Expression, error) {
+	if len(args) != 2 {
+		return nil, errFunctionArity.New("uast_extract", "2", len(args))
+	}
+	return NewUASTExtract(args[0], args[1]), nil
+}
@@ -0,0 +1,106 @@
+package gitbase
+
+import (
+	"testing"
+
+	"gopkg.in/bblfsh/sdk.v2/driver"
+	"gopkg.in/bblfsh/sdk.v2/uast/nodes"
+)
+
+func TestMarshalUnmarshalNodeRoundTrip(t *testing.T) {
+	nd := nodes.Object{
+		"@type": nodes.String("File"),
+		"name":  nodes.String("main.go"),
+		"size":  nodes.Int(42),
+		"ok":    nodes.Bool(true),
+	}
+
+	blob, err := marshalNode(nd)
+	if err != nil {
+		t.Fatalf("marshalNode: %v", err)
+	}
+
+	got, err := unmarshalNode(blob)
+	if err != nil {
+		t.Fatalf("unmarshalNode: %v", err)
+	}
+
+	obj, ok := got.(nodes.Object)
+	if !ok {
+		t.Fatalf("expected nodes.Object, got %T", got)
+	}
+
+	if obj["@type"] != nodes.String("File") {
+		t.Errorf("@type = %v, want File", obj["@type"])
+	}
+	if obj["name"] != nodes.String("main.go") {
+		t.Errorf("name = %v, want main.go", obj["name"])
+	}
+}
+
+func TestFilterXPathMatchesByType(t *testing.T) {
+	root := nodes.Object{
+		"@type": nodes.String("File"),
+		"body": nodes.Array{
+			nodes.Object{"@type": nodes.String("FuncDecl"), "name": nodes.String("main")},
+			nodes.Object{"@type": nodes.String("FuncDecl"), "name": nodes.String("helper")},
+			nodes.Object{"@type": nodes.String("Comment")},
+		},
+	}
+
+	matches := filterXPath(root, "//FuncDecl")
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+}
+
+func TestBuildUASTModeArity(t *testing.T) {
+	if _, err := buildUASTMode(); err == nil {
+		t.Fatal("expected an error for 0 arguments")
+	}
+
+	if _, err := buildUASTMode(nil, nil, nil); err != nil {
+		t.Fatalf("unexpected error for 3 arguments: %v", err)
+	}
+
+	if _, err := buildUASTMode(nil, nil, nil, nil); err != nil {
+		t.Fatalf("unexpected error for 4 arguments: %v", err)
+	}
+}
+
+func TestBuildUASTChildrenArity(t *testing.T) {
+	if _, err := buildUASTChildren(); err == nil {
+		t.Fatal("expected an error for 0 arguments")
+	}
+
+	if _, err := buildUASTChildren(nil, nil); err == nil {
+		t.Fatal("expected an error for 2 arguments")
+	}
+}
+
+func TestChildrenOfIsDeterministic(t *testing.T) {
+	obj := nodes.Object{
+		"b": nodes.Object{"@type": nodes.String("B")},
+		"a": nodes.Object{"@type": nodes.String("A")},
+		"c": nodes.Object{"@type": nodes.String("C")},
+	}
+
+	first := childrenOf(obj)
+	for i := 0; i < 10; i++ {
+		got := childrenOf(obj)
+		if len(got) != len(first) {
+			t.Fatalf("childrenOf returned %d children, want %d", len(got), len(first))
+		}
+		for j := range got {
+			if got[j].(nodes.Object)["@type"] != first[j].(nodes.Object)["@type"] {
+				t.Fatalf("childrenOf order changed between calls: %v != %v", got, first)
+			}
+		}
+	}
+}
+
+func TestParseUASTBlobRequiresRegisteredParser(t *testing.T) {
+	if _, err := parseUASTBlob(nil, []byte("x"), "no-such-lang", driver.ModeNative); err == nil {
+		t.Fatal("expected an error for a language with no registered native parser")
+	}
+}